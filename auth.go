@@ -0,0 +1,186 @@
+// Upstream AUTH mechanism translation: verify the client's credentials (passthrough or locally) and
+// re-authenticate to the upstream using whichever mechanism it actually advertises.
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// authCredentials is a local username -> bcrypt password hash map, used when -auth_translate is set to
+// verify client credentials itself instead of forwarding them upstream unchanged.
+type authCredentials map[string]string
+
+// loadAuthCredentials reads a "username:bcrypt-hash" file, one entry per line, blank lines and lines
+// starting with "#" are ignored. An empty path disables local verification (upstream decides instead).
+func loadAuthCredentials(path string) (authCredentials, error) {
+	if path == "" {
+		return nil, nil
+	}
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	creds := make(authCredentials)
+	for _, line := range strings.Split(string(raw), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		creds[parts[0]] = parts[1]
+	}
+	return creds, nil
+}
+
+// verify checks username/password against the loaded bcrypt hashes
+func (c authCredentials) verify(username, password string) bool {
+	hash, ok := c[username]
+	if !ok {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// decodePlainInitialResponse parses a base64 SASL PLAIN initial response of the form "\0user\0pass"
+func decodePlainInitialResponse(ir string) (username, password string, err error) {
+	raw, err := base64.StdEncoding.DecodeString(ir)
+	if err != nil {
+		return "", "", err
+	}
+	parts := strings.SplitN(string(raw), "\x00", 3)
+	if len(parts) != 3 {
+		return "", "", errors.New("auth: malformed PLAIN initial response")
+	}
+	return parts[1], parts[2], nil
+}
+
+// buildPlainInitialResponse builds the base64 SASL PLAIN initial response used to authenticate upstream
+func buildPlainInitialResponse(username, password string) string {
+	raw := "\x00" + username + "\x00" + password
+	return base64.StdEncoding.EncodeToString([]byte(raw))
+}
+
+// cramMD5Response computes the base64 "user hmac-md5-hex(challenge)" CRAM-MD5 response (RFC 2195) for
+// the given base64-encoded server challenge.
+func cramMD5Response(username, password, challengeB64 string) (string, error) {
+	challenge, err := base64.StdEncoding.DecodeString(challengeB64)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(md5.New, []byte(password))
+	mac.Write(challenge)
+	digest := hex.EncodeToString(mac.Sum(nil))
+	return base64.StdEncoding.EncodeToString([]byte(username + " " + digest)), nil
+}
+
+// xoauth2InitialResponse builds the base64 XOAUTH2 initial response for username, carrying token as a
+// bearer credential
+func xoauth2InitialResponse(username, token string) string {
+	raw := fmt.Sprintf("user=%s\x01auth=Bearer %s\x01\x01", username, token)
+	return base64.StdEncoding.EncodeToString([]byte(raw))
+}
+
+// decodeXOAUTH2InitialResponse parses a base64 SASL XOAUTH2 initial response of the form
+// "user=<username>\x01auth=Bearer <token>\x01\x01", as sent by the client.
+func decodeXOAUTH2InitialResponse(ir string) (username, token string, err error) {
+	raw, err := base64.StdEncoding.DecodeString(ir)
+	if err != nil {
+		return "", "", err
+	}
+	fields := strings.Split(string(raw), "\x01")
+	for _, f := range fields {
+		switch {
+		case strings.HasPrefix(f, "user="):
+			username = strings.TrimPrefix(f, "user=")
+		case strings.HasPrefix(strings.ToLower(f), "auth=bearer "):
+			token = f[len("auth=bearer "):]
+		}
+	}
+	if username == "" || token == "" {
+		return "", "", errors.New("auth: malformed XOAUTH2 initial response")
+	}
+	return username, token, nil
+}
+
+// tokenSource supplies a bearer token to use for XOAUTH2 authentication to the upstream, for username.
+type tokenSource func(username string) (string, error)
+
+// staticTokenSource always returns the same configured token, e.g. for a single shared service account.
+func staticTokenSource(token string) tokenSource {
+	return func(string) (string, error) { return token, nil }
+}
+
+// bestUpstreamMechanism picks the strongest mechanism this package knows how to translate to, out of the
+// upstream's advertised "AUTH ..." capability line, preferring XOAUTH2 > CRAM-MD5 > LOGIN > PLAIN.
+func bestUpstreamMechanism(caps []string) string {
+	upstreamMechs := make(map[string]bool)
+	for _, c := range caps {
+		if strings.HasPrefix(strings.ToUpper(c), "AUTH ") {
+			for _, m := range strings.Fields(c[5:]) {
+				upstreamMechs[strings.ToUpper(m)] = true
+			}
+		}
+	}
+	for _, pref := range []string{"XOAUTH2", "CRAM-MD5", "LOGIN", "PLAIN"} {
+		if upstreamMechs[pref] {
+			return pref
+		}
+	}
+	return ""
+}
+
+// authenticateUpstream drives the chosen upstream mechanism with the now-verified username/password (or
+// bearer token, for XOAUTH2), returning the final response from the upstream server.
+func (s *Session) authenticateUpstream(username, password string) (int, string, error) {
+	mech := bestUpstreamMechanism(s.upstream.Capabilities())
+	if mech == "" {
+		return 535, "5.7.8 Upstream offers no AUTH mechanism this proxy can translate to", errors.New("auth: no usable upstream mechanism")
+	}
+
+	switch mech {
+	case "PLAIN":
+		return s.upstream.MyCmd(235, "AUTH PLAIN "+buildPlainInitialResponse(username, password))
+
+	case "LOGIN":
+		if _, _, err := s.upstream.MyCmd(334, "AUTH LOGIN"); err != nil {
+			return 0, "", err
+		}
+		if _, _, err := s.upstream.MyCmd(334, base64.StdEncoding.EncodeToString([]byte(username))); err != nil {
+			return 0, "", err
+		}
+		return s.upstream.MyCmd(235, base64.StdEncoding.EncodeToString([]byte(password)))
+
+	case "CRAM-MD5":
+		_, challenge, err := s.upstream.MyCmd(334, "AUTH CRAM-MD5")
+		if err != nil {
+			return 0, "", err
+		}
+		resp, err := cramMD5Response(username, password, challenge)
+		if err != nil {
+			return 0, "", err
+		}
+		return s.upstream.MyCmd(235, resp)
+
+	case "XOAUTH2":
+		token, err := s.bkd.authTokenSource(username)
+		if err != nil {
+			return 0, "", err
+		}
+		return s.upstream.MyCmd(235, "AUTH XOAUTH2 "+xoauth2InitialResponse(username, token))
+
+	default:
+		return 504, "5.5.4 Unsupported upstream mechanism", fmt.Errorf("auth: unreachable mechanism %s", mech)
+	}
+}
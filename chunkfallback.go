@@ -0,0 +1,61 @@
+// Fallback path for ESMTP CHUNKING (BDAT): since go-smtpproxy's Client has no way to forward a chunk
+// upstream as BDAT, chunks are always buffered through a pipe and issued upstream as a single classic
+// DATA command instead.
+package main
+
+import (
+	"io"
+
+	"github.com/tuck1s/go-smtpproxy"
+)
+
+// chunkFallback buffers BDAT chunks into a pipe read by a single upstream DATA command, started the
+// first time a chunk arrives, finishing once the last chunk has been written.
+type chunkFallback struct {
+	pw     *io.PipeWriter
+	result chan bdatResult
+}
+
+type bdatResult struct {
+	code int
+	msg  string
+	err  error
+}
+
+// newChunkFallback starts the upstream DATA command in the background, fed by the returned fallback's Write.
+func newChunkFallback(upstream *smtpproxy.Client) *chunkFallback {
+	pr, pw := io.Pipe()
+	cf := &chunkFallback{pw: pw, result: make(chan bdatResult, 1)}
+	go func() {
+		w, code, msg, err := upstream.Data()
+		if err != nil {
+			pr.CloseWithError(err)
+			cf.result <- bdatResult{code, msg, err}
+			return
+		}
+		if _, err := io.Copy(w, pr); err != nil {
+			cf.result <- bdatResult{0, "DATA io.Copy error", err}
+			return
+		}
+		if err := w.Close(); err != nil {
+			cf.result <- bdatResult{0, "DATA Close error", err}
+			return
+		}
+		cf.result <- bdatResult{upstream.DataResponseCode, upstream.DataResponseMsg, nil}
+	}()
+	return cf
+}
+
+// Write buffers a chunk of message body for the in-flight upstream DATA command.
+func (cf *chunkFallback) Write(p []byte) (int, error) {
+	return cf.pw.Write(p)
+}
+
+// finish signals that the last chunk has been written and waits for the upstream DATA response.
+func (cf *chunkFallback) finish() (int, string, error) {
+	if err := cf.pw.Close(); err != nil {
+		return 0, "BDAT finish error", err
+	}
+	r := <-cf.result
+	return r.code, r.msg, r.err
+}
@@ -0,0 +1,101 @@
+// Streaming HTML rewriting: click-tracking link wrapper and open-pixel injection
+package main
+
+import (
+	"io"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// handleHTMLPart transfers an html MIME part, wrapping <a href> links for click tracking and injecting
+// an open-tracking pixel when tctx has tracking configured; otherwise it is a plain passthrough.
+func handleHTMLPart(dst io.Writer, src io.Reader, tctx *trackingContext) (int, error) {
+	if tctx == nil || tctx.cfg == nil {
+		written, err := io.Copy(dst, src) // Passthrough
+		return int(written), err
+	}
+	return rewriteHTMLStream(dst, src, tctx)
+}
+
+// rewriteHTMLStream tokenizes src and writes it to dst, rewriting <a href> targets and injecting the
+// open-tracking pixel before </body> (or at EOF if there is no </body>). Tokens that are not touched are
+// written out via their raw bytes, so the rest of the document survives byte-identical.
+func rewriteHTMLStream(dst io.Writer, src io.Reader, tctx *trackingContext) (int, error) {
+	z := html.NewTokenizer(src)
+	bytesWritten := 0
+	pixelInjected := false
+
+	for {
+		tt := z.Next()
+		// z.Token() may change the bytes behind z.Raw() (lower-casing names, unescaping values), so keep a copy
+		raw := append([]byte(nil), z.Raw()...)
+		if tt == html.ErrorToken {
+			if err := z.Err(); err != io.EOF {
+				return bytesWritten, err
+			}
+			if !pixelInjected {
+				bw, err := io.WriteString(dst, pixelImgTag(tctx))
+				bytesWritten += bw
+				if err != nil {
+					return bytesWritten, err
+				}
+			}
+			return bytesWritten, nil
+		}
+
+		if tt == html.StartTagToken {
+			tok := z.Token()
+			if tok.Data == "a" {
+				orig := tok.String()
+				rewriteAnchorHref(&tok, tctx)
+				if rewritten := tok.String(); rewritten != orig {
+					bw, err := io.WriteString(dst, rewritten)
+					bytesWritten += bw
+					if err != nil {
+						return bytesWritten, err
+					}
+					continue
+				}
+			}
+		}
+
+		if tt == html.EndTagToken {
+			tok := z.Token()
+			if tok.Data == "body" && !pixelInjected {
+				bw, err := io.WriteString(dst, pixelImgTag(tctx))
+				bytesWritten += bw
+				if err != nil {
+					return bytesWritten, err
+				}
+				pixelInjected = true
+			}
+		}
+
+		bw, err := dst.Write(raw)
+		bytesWritten += bw
+		if err != nil {
+			return bytesWritten, err
+		}
+	}
+}
+
+// rewriteAnchorHref rewrites tok's href attribute (if any) to a tracked click URL, unless tctx.cfg says
+// to leave it alone.
+func rewriteAnchorHref(tok *html.Token, tctx *trackingContext) {
+	for i, attr := range tok.Attr {
+		if !strings.EqualFold(attr.Key, "href") {
+			continue
+		}
+		if tctx.cfg.skipHref(attr.Val) {
+			return
+		}
+		tok.Attr[i].Val = tctx.cfg.clickURL(tctx.msgid, tctx.recipient, attr.Val)
+		return
+	}
+}
+
+// pixelImgTag returns the 1x1 open-tracking pixel to inject into the HTML body
+func pixelImgTag(tctx *trackingContext) string {
+	return `<img src="` + tctx.cfg.pixelURL(tctx.msgid, tctx.recipient) + `" width="1" height="1" alt="" />`
+}
@@ -0,0 +1,77 @@
+// lineLimitReader caps how long an unterminated SMTP command line may get, guarding against clients that
+// never send a CRLF. See RFC 5321 section 4.5.3.1.4 for the default 1000 octet line length.
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+)
+
+// errLineTooLong is surfaced once a line exceeds the configured maximum without a CRLF; callers turn it
+// into a "500 5.5.2 line too long" response and close the connection.
+var errLineTooLong = errors.New("500 5.5.2 line too long")
+
+// lineLimitReader wraps a client connection's reader, tracking how many bytes have arrived since the
+// last '\n' and failing the read once that exceeds maxLine. It is line-oriented rather than
+// connection-oriented: a well-formed line resets the count, however long the connection lives.
+type lineLimitReader struct {
+	r       io.Reader
+	maxLine int
+	lineLen int
+}
+
+// newLineLimitReader wraps r, capping any CRLF-terminated line at maxLine bytes
+func newLineLimitReader(r io.Reader, maxLine int) *lineLimitReader {
+	return &lineLimitReader{r: r, maxLine: maxLine}
+}
+
+func (l *lineLimitReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	for i := 0; i < n; i++ {
+		if p[i] == '\n' {
+			l.lineLen = 0
+			continue
+		}
+		l.lineLen++
+		if l.lineLen > l.maxLine {
+			return i + 1, errLineTooLong
+		}
+	}
+	return n, err
+}
+
+// limitedConn wraps a client net.Conn, capping command line length via lineLimitReader. On
+// errLineTooLong it writes the SMTP response itself and reports an error to the caller so the server's
+// accept loop tears the connection down - the same shape as any other read error it already has to handle.
+type limitedConn struct {
+	net.Conn
+	lr *lineLimitReader
+}
+
+func (c *limitedConn) Read(p []byte) (int, error) {
+	n, err := c.lr.Read(p)
+	if err == errLineTooLong {
+		io.WriteString(c.Conn, errLineTooLong.Error()+"\r\n")
+	}
+	return n, err
+}
+
+// limitedListener wraps a net.Listener so every accepted connection is capped at maxLine bytes per line.
+type limitedListener struct {
+	net.Listener
+	maxLine int
+}
+
+// newLineLimitListener wraps l, capping every accepted connection's command lines at maxLine bytes.
+func newLineLimitListener(l net.Listener, maxLine int) net.Listener {
+	return &limitedListener{Listener: l, maxLine: maxLine}
+}
+
+func (l *limitedListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &limitedConn{Conn: c, lr: newLineLimitReader(c, l.maxLine)}, nil
+}
@@ -3,6 +3,7 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/base64"
 	"io"
 	"log"
@@ -16,6 +17,14 @@ import (
 
 const smtpCRLF = "\r\n"
 
+// trackingContext carries the engagement-tracking parameters for a single message down through the
+// MIME walk. cfg is nil when tracking is disabled, in which case msgid/recipient are unused.
+type trackingContext struct {
+	cfg       *trackingConfig
+	msgid     string
+	recipient string
+}
+
 /* If you just want to pass through the entire mail headers and body, you can just use
    the following alernative:
 
@@ -24,14 +33,37 @@ func MailCopy(dst io.Writer, src io.Reader) (int64, error) {
 }
 */
 
-// mailCopy transfers the mail body from downstream (client) to upstream (server)
-// The writer will be closed by the parent function, no need to close it here.
-func mailCopy(dst io.Writer, src io.Reader) (int, error) {
+// mailCopy transfers the mail body from downstream (client) to upstream (server), optionally DKIM-signing
+// and engagement-tracking it on the way through. The writer will be closed by the parent function, no
+// need to close it here.
+func mailCopy(dst io.Writer, src io.Reader, signer *dkimSigner, tracking *trackingConfig, recipient string) (int, error) {
 	bytesWritten := 0
 	message, err := mail.ReadMessage(bufio.NewReader(src))
 	if err != nil {
 		return bytesWritten, err
 	}
+	tctx := &trackingContext{cfg: tracking, msgid: message.Header.Get("Message-Id"), recipient: recipient}
+
+	// With a signer configured, the body hash and signature aren't known until the whole (possibly
+	// rewritten) body has been produced, so the body is walked into a buffer first and the signature
+	// header written ahead of the others. Without a signer, the body streams to dst after the headers.
+	var bodyBuf bytes.Buffer
+	if signer != nil {
+		bodyBytes, err := handleMessageBody(&bodyBuf, message.Header, message.Body, tctx)
+		if err != nil {
+			return bodyBytes, err
+		}
+		sig, err := signer.sign(message.Header, bodyBuf.Bytes())
+		if err != nil {
+			return bytesWritten, err
+		}
+		hdrLine := "DKIM-Signature: " + sig + smtpCRLF
+		bw, err := io.WriteString(dst, hdrLine)
+		bytesWritten += bw
+		if err != nil {
+			return bytesWritten, err
+		}
+	}
 
 	// Pass through headers. The m.Header map does not preserve order, but that should not matter.
 	for hdrType, hdrList := range message.Header {
@@ -52,8 +84,11 @@ func mailCopy(dst io.Writer, src io.Reader) (int, error) {
 		return bytesWritten, err
 	}
 
-	// Handle the message body
-	bw, err = handleMessageBody(dst, message.Header, message.Body)
+	if signer == nil {
+		bw, err = handleMessageBody(dst, message.Header, message.Body, tctx)
+	} else {
+		bw, err = dst.Write(bodyBuf.Bytes())
+	}
 	bytesWritten += bw
 	return bytesWritten, err
 }
@@ -61,15 +96,15 @@ func mailCopy(dst io.Writer, src io.Reader) (int, error) {
 // handleMessageBody copies the mail message from msg to dst, with awareness of MIME parts.
 // This is probably a naive implementation when it comes to complex multi-part messages and
 // differing encodings.
-func handleMessageBody(dst io.Writer, msgHeader mail.Header, msgBody io.Reader) (int, error) {
+func handleMessageBody(dst io.Writer, msgHeader mail.Header, msgBody io.Reader, tctx *trackingContext) (int, error) {
 	cType := msgHeader.Get("Content-Type")
 	cte := msgHeader.Get("Content-Transfer-Encoding")
-	return handleMessagePart(dst, msgBody, cType, cte)
+	return handleMessagePart(dst, msgBody, cType, cte, tctx)
 }
 
 // handleMessagePart walks the MIME structure, and may be called recursively. The incoming
 // content type and cte (content transfer encoding) are passed separately
-func handleMessagePart(dst io.Writer, part io.Reader, cType string, cte string) (int, error) {
+func handleMessagePart(dst io.Writer, part io.Reader, cType string, cte string, tctx *trackingContext) (int, error) {
 	bytesWritten := 0
 	// Check what MIME media type we have.
 	mediaType, params, err := mime.ParseMediaType(cType)
@@ -92,14 +127,15 @@ func handleMessagePart(dst io.Writer, part io.Reader, cType string, cte string)
 			}
 		}
 		dst = quotedprintable.NewWriter(dst)
-		bytesWritten, err = handleHTMLPart(dst, part)
+		bytesWritten, err = handleHTMLPart(dst, part, tctx)
 	} else {
 		if strings.HasPrefix(mediaType, "multipart/") {
 			mr := multipart.NewReader(part, params["boundary"])
-			bytesWritten, err = handleMultiPart(dst, mr, params["boundary"])
+			bytesWritten, err = handleMultiPart(dst, mr, params["boundary"], tctx)
 		} else {
 			if strings.HasPrefix(mediaType, "message/rfc822") {
-				bytesWritten, err = mailCopy(dst, part)
+				// Nested messages are not separately DKIM-signed or tracked; only the outer message is.
+				bytesWritten, err = mailCopy(dst, part, nil, nil, "")
 			} else {
 				// Everything else such as text/plain, image/gif etc pass through
 				bytesWritten, err = handlePlainPart(dst, part)
@@ -115,14 +151,8 @@ func handlePlainPart(dst io.Writer, src io.Reader) (int, error) {
 	return int(written), err
 }
 
-// Transfer through an html MIME part, wrapping links etc
-func handleHTMLPart(dst io.Writer, src io.Reader) (int, error) {
-	written, err := io.Copy(dst, src) // Passthrough
-	return int(written), err
-}
-
 // Transfer through a multipart message, handling recursively as needed
-func handleMultiPart(dst io.Writer, mr *multipart.Reader, bound string) (int, error) {
+func handleMultiPart(dst io.Writer, mr *multipart.Reader, bound string, tctx *trackingContext) (int, error) {
 	bytesWritten := 0
 	var err error
 	// Insert the
@@ -162,7 +192,7 @@ func handleMultiPart(dst io.Writer, mr *multipart.Reader, bound string) (int, er
 				return bytesWritten, err
 			}
 		}
-		bw, err := handleMessagePart(pWrt2, p, cType, cte)
+		bw, err := handleMessagePart(pWrt2, p, cType, cte, tctx)
 		bytesWritten += bw
 		if err != nil {
 			return bytesWritten, err
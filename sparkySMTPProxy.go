@@ -5,10 +5,13 @@ import (
 	"crypto/x509"
 	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/tuck1s/go-smtpproxy"
@@ -24,6 +27,17 @@ func Contains(a []string, x string) bool {
 	return false
 }
 
+// removeCapability returns a copy of caps with any entry equal to x dropped.
+func removeCapability(caps []string, x string) []string {
+	out := caps[:0:0]
+	for _, c := range caps {
+		if c != x {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
 //-----------------------------------------------------------------------------
 // Backend handlers
 //-----------------------------------------------------------------------------
@@ -33,6 +47,15 @@ type Backend struct {
 	outHostPort        string
 	verbose            bool
 	requireUpstreamTLS bool
+	dkim               *dkimSigner     // optional DKIM signer for passthrough messages, nil if disabled
+	upstreamPolicy     *UpstreamPolicy // MTA-STS / DANE TLSA verification of the upstream TLS certificate
+	tracking           *trackingConfig // optional engagement tracking for HTML parts, nil if disabled
+
+	authTranslate   bool            // if true, verify AUTH locally/as-presented and re-authenticate upstream
+	authCreds       authCredentials // local username -> bcrypt hash map, nil to trust the presented credentials
+	authTokenSource tokenSource     // supplies bearer tokens for upstream XOAUTH2
+
+	maxErrors int // sessions are blocked once this many malformed commands/upstream errors are seen, see Session.recordError
 }
 
 func (bkd *Backend) logger(args ...interface{}) {
@@ -64,6 +87,17 @@ type Session struct {
 	bkd           *Backend          // The backend that created this session. Allows session methods to e.g. log
 	upstream      *smtpproxy.Client // the upstream client this backend is driving
 	blockUpstream bool              // Flag to prevent any further use of this session
+
+	upstreamChunking bool // true once Greet has seen CHUNKING in the upstream's capabilities
+	bytesReceived    int  // message bytes received via BDAT, or written upstream (after any rewriting) via DATA, reset on MAIL/RSET
+
+	chunkFallback *chunkFallback // non-nil while buffering BDAT chunks into the upstream DATA fallback
+
+	rcptto []string // recipients seen so far this transaction, reset on MAIL/RSET
+
+	greeted  bool // true once Greet has completed successfully
+	quit     bool // true once QUIT has been processed - any further command is a pipelining violation
+	errCount int  // malformed commands / upstream errors seen so far, see Backend.maxErrors
 }
 
 const upstreamBlockMsg = "Unable to handle messages at the moment, sorry"
@@ -102,6 +136,18 @@ func (s *Session) Greet(helotype string) ([]string, int, string, error) {
 	s.bkd.logger(respTwiddle(s), helotype, "success")
 	caps := s.upstream.Capabilities()
 	s.bkd.logger("\tUpstream capabilities:", caps)
+	s.upstreamChunking = Contains(caps, "CHUNKING")
+
+	// CHUNKING/BDAT is not wired end-to-end: go-smtpproxy's Client has no BDAT method to forward a chunk
+	// upstream with, and its Server command dispatch has no route from a "BDAT ..." line into
+	// Session.BDAT - both would need changes inside that external package, which isn't vendored into
+	// this tree. Advertising CHUNKING would invite a compliant client to send BDAT, which would then
+	// fall through to Unknown/Passthru and corrupt the session, so it's stripped from whatever the
+	// upstream advertises until that dispatch support exists. BINARYMIME is withheld for the same
+	// reason - it's only meaningful alongside CHUNKING. Session.BDAT and chunkFallback are kept as the
+	// session-state half of this feature, ready to wire up once the upstream dispatch support lands.
+	caps = removeCapability(caps, "CHUNKING")
+	caps = removeCapability(caps, "BINARYMIME")
 
 	// Check for "eager" upstream TLS mode
 	if _, isTLS := s.upstream.TLSConnectionState(); !isTLS && s.bkd.requireUpstreamTLS {
@@ -115,9 +161,38 @@ func (s *Session) Greet(helotype string) ([]string, int, string, error) {
 			s.blockUpstream = true // Prevent any further use of this session
 		}
 	}
+	if err == nil {
+		s.greeted = true
+	}
 	return caps, code, msg, err
 }
 
+// checkSequence enforces that commands only arrive between a completed EHLO/HELO and QUIT, rejecting
+// anything pipelined outside that window with "503 5.5.1 bad sequence of commands".
+func (s *Session) checkSequence() (int, string, error) {
+	if s.quit {
+		s.bkd.logger("\tCommand received after QUIT")
+		return 503, "5.5.1 bad sequence of commands", errors.New("smtp: command received after QUIT")
+	}
+	if !s.greeted {
+		s.bkd.logger("\tCommand received before EHLO/HELO completed")
+		return 503, "5.5.1 bad sequence of commands", errors.New("smtp: command received before EHLO/HELO")
+	}
+	return 0, "", nil
+}
+
+// recordError counts a malformed command or upstream error against Backend.maxErrors, blocking the
+// session once the threshold is crossed to mitigate probing and brute-force attempts.
+func (s *Session) recordError() (int, string, error) {
+	s.errCount++
+	if s.bkd.maxErrors > 0 && s.errCount >= s.bkd.maxErrors {
+		s.blockUpstream = true
+		s.bkd.logger("\tError threshold", s.bkd.maxErrors, "exceeded, dropping connection")
+		return upstreamBlockCode, "4.7.0 Too many errors, closing connection", errors.New("smtp: error threshold exceeded")
+	}
+	return 0, "", nil
+}
+
 // StartTLS command
 func (s *Session) StartTLS() (int, string, error) {
 	if _, isTLS := s.upstream.TLSConnectionState(); isTLS {
@@ -134,48 +209,172 @@ func (s *Session) StartTLS() (int, string, error) {
 		InsecureSkipVerify: false,
 		ServerName:         host,
 	}
+	if s.bkd.upstreamPolicy != nil && s.bkd.upstreamPolicy.enabled {
+		// Default verification is disabled in favour of explicit MTA-STS + DANE checking below,
+		// which needs the raw chain to match against TLSA records.
+		tlsconfig.InsecureSkipVerify = true
+		tlsconfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return s.bkd.upstreamPolicy.Verify(host, rawCerts)
+		}
+	}
 	s.bkd.logger(cmdTwiddle(s), "STARTTLS")
 	if s.blockUpstream {
 		s.bkd.logger("\t", upstreamBlockMsg)
 		return upstreamBlockCode, "4.0.0 " + upstreamBlockMsg, errors.New(upstreamBlockMsg)
 	}
 	code, msg, err := s.upstream.StartTLS(tlsconfig)
+	if err != nil && s.bkd.upstreamPolicy != nil && s.bkd.upstreamPolicy.enabled {
+		s.bkd.logger(respTwiddle(s), "STARTTLS blocked by upstream policy", err)
+		s.blockUpstream = true
+		return upstreamBlockCode, "4.7.0 " + upstreamBlockMsg, err
+	}
 	s.bkd.logger(respTwiddle(s), code, msg)
 	return code, msg, err
 }
 
 //Auth command backend handler
 func (s *Session) Auth(expectcode int, cmd, arg string) (int, string, error) {
-	return s.Passthru(expectcode, cmd, arg)
+	if !s.bkd.authTranslate {
+		return s.Passthru(expectcode, cmd, arg)
+	}
+	s.bkd.logger(cmdTwiddle(s), cmd, arg)
+	if s.blockUpstream {
+		s.bkd.logger("\t", upstreamBlockMsg)
+		return upstreamBlockCode, "4.0.0 " + upstreamBlockMsg, errors.New(upstreamBlockMsg)
+	}
+
+	fields := strings.SplitN(arg, " ", 2)
+	mech := strings.ToUpper(fields[0])
+	var ir string
+	if len(fields) > 1 {
+		ir = fields[1]
+	}
+
+	// Scope: only mechanisms that carry the full credential in a single initial response can be
+	// translated here. Session.Auth is handed one already-assembled command line (expectcode, cmd, arg)
+	// the same way Passthru is, with no reader onto the client connection of the kind DataCommand/Data
+	// get for the message body - so a mechanism needing a server-generated challenge before the client
+	// responds (plain LOGIN/CRAM-MD5 from the client's side) can't be driven to completion from inside
+	// this call. Supporting those would mean terminating a stateful SASL exchange with the client, which
+	// needs a hook this backend interface doesn't expose; PLAIN and XOAUTH2 both fit because, like here,
+	// the whole credential rides in the initial response.
+	if mech == "LOGIN" || mech == "CRAM-MD5" {
+		return 504, "5.5.4 AUTH " + mech + " from the client requires a challenge/response this proxy can't terminate, use PLAIN or XOAUTH2 with an initial response", fmt.Errorf("auth: client mechanism %s needs a server challenge, not supported", mech)
+	}
+
+	var username, password string
+	var err error
+	switch mech {
+	case "PLAIN":
+		if ir == "" {
+			return 535, "5.7.8 AUTH PLAIN requires an initial response", errors.New("auth: PLAIN without initial response is not supported")
+		}
+		username, password, err = decodePlainInitialResponse(ir)
+
+	case "XOAUTH2":
+		if ir == "" {
+			return 535, "5.7.8 AUTH XOAUTH2 requires an initial response", errors.New("auth: XOAUTH2 without initial response is not supported")
+		}
+		var token string
+		username, token, err = decodeXOAUTH2InitialResponse(ir)
+		if err != nil {
+			break
+		}
+		// The client's bearer token proves its own identity but isn't a password, so it can only be
+		// carried through to an upstream that also speaks XOAUTH2; there's no password to fall back to
+		// for translating it into PLAIN/LOGIN/CRAM-MD5.
+		if bestUpstreamMechanism(s.upstream.Capabilities()) != "XOAUTH2" {
+			err = errors.New("auth: upstream does not support XOAUTH2, cannot translate client bearer token")
+			s.bkd.logger(respTwiddle(s), "AUTH error", err)
+			return 535, "5.7.8 Upstream cannot accept a translated XOAUTH2 credential", err
+		}
+		code, msg, uerr := s.upstream.MyCmd(235, "AUTH XOAUTH2 "+xoauth2InitialResponse(username, token))
+		if uerr != nil {
+			s.bkd.logger(respTwiddle(s), "AUTH upstream error", uerr)
+		} else {
+			s.bkd.logger(respTwiddle(s), code, msg)
+		}
+		return code, msg, uerr
+
+	default:
+		return 504, "5.5.4 Unrecognised or unsupported authentication mechanism", fmt.Errorf("auth: unsupported client mechanism %s", mech)
+	}
+	if err != nil {
+		s.bkd.logger(respTwiddle(s), "AUTH error", err)
+		return 501, "5.5.4 Syntax error in AUTH", err
+	}
+
+	if s.bkd.authCreds != nil && !s.bkd.authCreds.verify(username, password) {
+		s.bkd.logger(respTwiddle(s), "AUTH rejected: bad local credentials for", username)
+		return 535, "5.7.8 Authentication credentials invalid", errors.New("auth: local credential check failed")
+	}
+
+	code, msg, err := s.authenticateUpstream(username, password)
+	if err != nil {
+		s.bkd.logger(respTwiddle(s), "AUTH upstream error", err)
+	} else {
+		s.bkd.logger(respTwiddle(s), code, msg)
+	}
+	return code, msg, err
 }
 
 //Mail command backend handler
 func (s *Session) Mail(expectcode int, cmd, arg string) (int, string, error) {
+	s.bytesReceived = 0
+	s.chunkFallback = nil
+	s.rcptto = nil
 	return s.Passthru(expectcode, cmd, arg)
 }
 
 //Rcpt command backend handler
 func (s *Session) Rcpt(expectcode int, cmd, arg string) (int, string, error) {
-	return s.Passthru(expectcode, cmd, arg)
+	code, msg, err := s.Passthru(expectcode, cmd, arg)
+	if err == nil {
+		s.rcptto = append(s.rcptto, parseMailboxArg(arg))
+	}
+	return code, msg, err
 }
 
 //Reset command backend handler
 func (s *Session) Reset(expectcode int, cmd, arg string) (int, string, error) {
+	s.bytesReceived = 0
+	s.chunkFallback = nil
+	s.rcptto = nil
 	return s.Passthru(expectcode, cmd, arg)
 }
 
+// parseMailboxArg extracts the mailbox address from a MAIL FROM / RCPT TO argument, e.g.
+// "TO:<user@example.com> SIZE=1000" -> "user@example.com". Falls back to the raw argument if there's
+// no angle-bracketed address to find.
+func parseMailboxArg(arg string) string {
+	start := strings.IndexByte(arg, '<')
+	end := strings.IndexByte(arg, '>')
+	if start >= 0 && end > start {
+		return arg[start+1 : end]
+	}
+	return strings.TrimSpace(arg)
+}
+
 //Quit command backend handler
 func (s *Session) Quit(expectcode int, cmd, arg string) (int, string, error) {
-	return s.Passthru(expectcode, cmd, arg)
+	code, msg, err := s.Passthru(expectcode, cmd, arg)
+	s.quit = true
+	return code, msg, err
 }
 
 //Unknown command backend handler
 func (s *Session) Unknown(expectcode int, cmd, arg string) (int, string, error) {
+	if code, msg, err := s.recordError(); err != nil {
+		return code, msg, err
+	}
 	return s.Passthru(expectcode, cmd, arg)
 }
 
 // Passthru a command to the upstream server, logging
 func (s *Session) Passthru(expectcode int, cmd, arg string) (int, string, error) {
+	if code, msg, err := s.checkSequence(); err != nil {
+		return code, msg, err
+	}
 	s.bkd.logger(cmdTwiddle(s), cmd, arg)
 	if s.blockUpstream {
 		s.bkd.logger("\t", upstreamBlockMsg)
@@ -187,11 +386,19 @@ func (s *Session) Passthru(expectcode int, cmd, arg string) (int, string, error)
 	}
 	code, msg, err := s.upstream.MyCmd(expectcode, joined)
 	s.bkd.logger(respTwiddle(s), code, msg)
+	if err != nil {
+		if ec, em, eerr := s.recordError(); eerr != nil {
+			return ec, em, eerr
+		}
+	}
 	return code, msg, err
 }
 
 // DataCommand pass upstream, returning a place to write the data AND the usual responses
 func (s *Session) DataCommand() (io.WriteCloser, int, string, error) {
+	if code, msg, err := s.checkSequence(); err != nil {
+		return nil, code, msg, err
+	}
 	s.bkd.logger(cmdTwiddle(s), "DATA")
 	if s.blockUpstream {
 		s.bkd.logger("\t", upstreamBlockMsg)
@@ -206,7 +413,12 @@ func (s *Session) DataCommand() (io.WriteCloser, int, string, error) {
 
 // Data body (dot delimited) pass upstream, returning the usual responses
 func (s *Session) Data(r io.Reader, w io.WriteCloser) (int, string, error) {
-	_, err := io.Copy(w, r)
+	var recipient string
+	if len(s.rcptto) > 0 {
+		recipient = s.rcptto[len(s.rcptto)-1]
+	}
+	n, err := mailCopy(w, r, s.bkd.dkim, s.bkd.tracking, recipient)
+	s.bytesReceived += n
 	if err != nil {
 		msg := "DATA io.Copy error"
 		s.bkd.logger(respTwiddle(s), msg, err)
@@ -223,6 +435,41 @@ func (s *Session) Data(r io.Reader, w io.WriteCloser) (int, string, error) {
 	return code, msg, err
 }
 
+// BDAT handles one chunk of an ESMTP CHUNKING transfer (RFC 3030). chunkSize bytes are read from r, which
+// is already limited by the caller to exactly that many bytes; last is true on the final "BDAT n LAST".
+// smtpproxy.Client has no BDAT method to forward a chunk upstream verbatim with, so every chunk is
+// buffered via chunkFallback regardless of what the upstream advertised, and issued upstream as a single
+// DATA once the last chunk has been seen. Greet never advertises CHUNKING to the client (see Greet), so
+// in practice this method is not reachable until go-smtpproxy's server dispatch routes BDAT to it; it's
+// kept ready for when that wiring exists.
+func (s *Session) BDAT(chunkSize int, last bool, r io.Reader) (int, string, error) {
+	if code, msg, err := s.checkSequence(); err != nil {
+		return code, msg, err
+	}
+	s.bkd.logger(cmdTwiddle(s), "BDAT", chunkSize, last)
+	if s.blockUpstream {
+		s.bkd.logger("\t", upstreamBlockMsg)
+		return upstreamBlockCode, "4.0.0 " + upstreamBlockMsg, errors.New(upstreamBlockMsg)
+	}
+
+	if s.chunkFallback == nil {
+		s.chunkFallback = newChunkFallback(s.upstream)
+	}
+	n, err := io.CopyN(s.chunkFallback, r, int64(chunkSize))
+	s.bytesReceived += int(n)
+	if err != nil {
+		s.bkd.logger(respTwiddle(s), "BDAT buffering error", err)
+		return 0, "BDAT buffering error", err
+	}
+	if !last {
+		return 250, "2.0.0 " + strconv.Itoa(chunkSize) + " octets received", nil
+	}
+	code, msg, err := s.chunkFallback.finish()
+	s.chunkFallback = nil // the pipe is now closed and fully drained; never reuse it for the next message
+	s.bkd.logger(respTwiddle(s), code, msg)
+	return code, msg, err
+}
+
 //-----------------------------------------------------------------------------
 
 func main() {
@@ -233,6 +480,19 @@ func main() {
 	privkeyfile := flag.String("privkeyfile", "", "Private key file for this server")
 	serverDebug := flag.String("server_debug", "", "File to write server SMTP conversation for debugging")
 	requireUpstreamTLS := flag.Bool("require_upstream_tls", false, "Force upstream server to TLS (raise error if it can't)")
+	dkimSelector := flag.String("dkim_selector", "", "DKIM selector to sign outgoing messages with (requires dkim_domain and dkim_keyfile)")
+	dkimDomain := flag.String("dkim_domain", "", "DKIM signing domain (d=)")
+	dkimKeyfile := flag.String("dkim_keyfile", "", "PEM file holding the RSA or Ed25519 private key to sign with")
+	dkimHeaders := flag.String("dkim_headers", strings.Join(defaultDKIMHeaders, ","), "Comma-separated list of headers to cover in the DKIM signature (h=)")
+	upstreamPolicyOpt := flag.Bool("upstream_policy", false, "Verify the upstream TLS certificate against its published MTA-STS policy and DANE TLSA records")
+	dnssecResolver := flag.String("dnssec_resolver", "127.0.0.1:53", "host:port of a DNSSEC-validating resolver, used for TLSA lookups")
+	trackingHost := flag.String("tracking_host", "", "Host to rewrite HTML links/open-pixels to for engagement tracking (disabled if empty)")
+	trackingSecret := flag.String("tracking_secret", "", "HMAC-SHA256 key used to sign tracking URLs (required if tracking_host is set)")
+	authTranslateOpt := flag.Bool("auth_translate", false, "Verify client AUTH locally and re-authenticate upstream with its best mechanism, instead of passing the client's mechanism straight through")
+	authCredsFile := flag.String("auth_creds_file", "", "Optional username:bcrypt-hash file to verify client credentials against locally (default: trust the presented credentials)")
+	authXOAUTH2Token := flag.String("auth_xoauth2_token", "", "Bearer token to present when translating to upstream XOAUTH2")
+	maxLineLength := flag.Int("max_line_length", 1000, "Maximum bytes per SMTP command line, per RFC 5321 section 4.5.3.1.4")
+	maxErrors := flag.Int("max_errors", 3, "Drop the connection once this many malformed commands/upstream errors are seen (0 disables)")
 	flag.Parse()
 
 	log.Println("Incoming host:port set to", *inHostPort)
@@ -243,12 +503,44 @@ func main() {
 		outHostPort:        *outHostPort,
 		verbose:            *verboseOpt,
 		requireUpstreamTLS: *requireUpstreamTLS,
+		upstreamPolicy:     NewUpstreamPolicy(*upstreamPolicyOpt, *dnssecResolver),
+	}
+	if *upstreamPolicyOpt {
+		log.Println("Upstream MTA-STS / DANE policy verification enabled, using resolver", *dnssecResolver)
+	}
+
+	if *dkimSelector != "" || *dkimDomain != "" || *dkimKeyfile != "" {
+		signer, err := newDKIMSigner(*dkimSelector, *dkimDomain, *dkimKeyfile, strings.Split(*dkimHeaders, ","))
+		if err != nil {
+			log.Fatal(err)
+		}
+		be.dkim = signer
+		log.Println("DKIM signing enabled for domain", *dkimDomain, "selector", *dkimSelector)
+	}
+
+	be.tracking = newTrackingConfig(*trackingHost, *trackingSecret)
+	if be.tracking != nil {
+		log.Println("Engagement tracking enabled, rewriting HTML links/pixels to", *trackingHost)
+	}
+
+	be.authTranslate = *authTranslateOpt
+	if be.authTranslate {
+		creds, err := loadAuthCredentials(*authCredsFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		be.authCreds = creds
+		be.authTokenSource = staticTokenSource(*authXOAUTH2Token)
+		log.Println("AUTH translation enabled")
 	}
+	be.maxErrors = *maxErrors
 
 	s := smtpproxy.NewServer(be)
 	s.Addr = *inHostPort
 	s.ReadTimeout = 60 * time.Second
 	s.WriteTimeout = 60 * time.Second
+	// Error-threshold dropping is enforced entirely on our side via Backend.maxErrors/Session.recordError,
+	// so it needs nothing from the server beyond the commands it already passes through.
 
 	subject, err := os.Hostname() // This is the fallback in case we have no cert / privkey to give us a Subject
 	if err != nil {
@@ -288,7 +580,19 @@ func main() {
 		log.Println("Server logging SMTP commands and responses to", dbgFile.Name())
 	}
 
-	if err := s.ListenAndServe(); err != nil {
+	ln, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *maxLineLength > 0 {
+		// Caps how long a client can send an unterminated line before we give up and drop the
+		// connection; see lineLimitReader.go. Done at the net.Conn level, ahead of the server's own
+		// line reading, so it applies uniformly to every command without relying on a field of the
+		// external smtpproxy.Server.
+		ln = newLineLimitListener(ln, *maxLineLength)
+		log.Println("Maximum SMTP command line length set to", *maxLineLength, "bytes")
+	}
+	if err := s.Serve(ln); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -0,0 +1,68 @@
+// Engagement tracking: link wrapping and open-pixel injection for outbound HTML mail parts
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/url"
+	"strings"
+)
+
+// trackingConfig holds the parameters needed to build click/open tracking URLs
+type trackingConfig struct {
+	host   string // tracking host, e.g. "track.example.com"
+	secret []byte // HMAC-SHA256 key used to sign tracking URLs
+}
+
+// newTrackingConfig builds a trackingConfig, or returns nil if tracking is not configured
+func newTrackingConfig(host, secret string) *trackingConfig {
+	if host == "" || secret == "" {
+		return nil
+	}
+	return &trackingConfig{host: host, secret: []byte(secret)}
+}
+
+// sign returns the hex-encoded HMAC-SHA256 over the given parts, joined with "\x00"
+func (t *trackingConfig) sign(parts ...string) string {
+	mac := hmac.New(sha256.New, t.secret)
+	mac.Write([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// cleanMsgid strips the angle brackets from a Message-ID header value and escapes it for use in a URL path
+func cleanMsgid(msgid string) string {
+	msgid = strings.TrimPrefix(msgid, "<")
+	msgid = strings.TrimSuffix(msgid, ">")
+	return url.PathEscape(msgid)
+}
+
+// clickURL builds the tracked redirect URL for an href target
+func (t *trackingConfig) clickURL(msgid, recipient, target string) string {
+	encTarget := base64.RawURLEncoding.EncodeToString([]byte(target))
+	sig := t.sign(msgid, target, recipient)
+	return "https://" + t.host + "/click/" + cleanMsgid(msgid) + "/" + encTarget + "?s=" + sig
+}
+
+// pixelURL builds the open-tracking pixel URL for a message
+func (t *trackingConfig) pixelURL(msgid, recipient string) string {
+	sig := t.sign(msgid, recipient)
+	return "https://" + t.host + "/open/" + cleanMsgid(msgid) + "?s=" + sig
+}
+
+// skipHref reports whether an href should be left alone rather than wrapped: mailto:/tel: links,
+// same-page fragments, and links already pointing at the tracking host.
+func (t *trackingConfig) skipHref(href string) bool {
+	lower := strings.ToLower(strings.TrimSpace(href))
+	if lower == "" || strings.HasPrefix(lower, "#") {
+		return true
+	}
+	if strings.HasPrefix(lower, "mailto:") || strings.HasPrefix(lower, "tel:") {
+		return true
+	}
+	if u, err := url.Parse(href); err == nil && u.Host != "" && strings.EqualFold(u.Host, t.host) {
+		return true
+	}
+	return false
+}
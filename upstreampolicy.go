@@ -0,0 +1,313 @@
+// Upstream MTA-STS and DANE TLSA policy lookup and enforcement for the forwarding Client's STARTTLS
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// mtaSTSPolicy is a parsed "https://mta-sts.<domain>/.well-known/mta-sts.txt" policy file
+type mtaSTSPolicy struct {
+	mode       string // "enforce", "testing" or "none"
+	mxPatterns []string
+	maxAge     time.Duration
+	fetchedAt  time.Time
+}
+
+func (p *mtaSTSPolicy) expired() bool {
+	return time.Since(p.fetchedAt) > p.maxAge
+}
+
+// matchesMX reports whether host satisfies one of the policy's mx patterns (RFC 8461 section 4.1),
+// where a leading "*." matches exactly one DNS label.
+func (p *mtaSTSPolicy) matchesMX(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, pat := range p.mxPatterns {
+		pat = strings.ToLower(pat)
+		if strings.HasPrefix(pat, "*.") {
+			suffix := pat[1:] // ".example.com"
+			if strings.HasSuffix(host, suffix) && strings.Count(host[:len(host)-len(suffix)], ".") == 0 {
+				return true
+			}
+		} else if host == pat {
+			return true
+		}
+	}
+	return false
+}
+
+// tlsaRecord is a single TLSA resource record, see RFC 6698
+type tlsaRecord struct {
+	usage        uint8 // 2 = DANE-TA, 3 = DANE-EE
+	selector     uint8 // 0 = full certificate, 1 = SubjectPublicKeyInfo
+	matchingType uint8 // 1 = SHA-256
+	data         []byte
+}
+
+// UpstreamPolicy resolves and caches MTA-STS policies and TLSA records for upstream destination domains,
+// and validates the upstream TLS certificate against them during STARTTLS.
+type UpstreamPolicy struct {
+	enabled  bool
+	resolver string // host:port of a DNSSEC-validating resolver to query for TLSA records
+
+	mu    sync.Mutex
+	cache map[string]*mtaSTSPolicy
+}
+
+// NewUpstreamPolicy builds an UpstreamPolicy subsystem. When enabled is false, Verify always succeeds,
+// preserving today's plain PKIX/hostname behaviour.
+func NewUpstreamPolicy(enabled bool, resolver string) *UpstreamPolicy {
+	return &UpstreamPolicy{
+		enabled:  enabled,
+		resolver: resolver,
+		cache:    make(map[string]*mtaSTSPolicy),
+	}
+}
+
+// policyFor returns the (possibly cached) MTA-STS policy for domain, or nil if none is published.
+func (up *UpstreamPolicy) policyFor(domain string) (*mtaSTSPolicy, error) {
+	up.mu.Lock()
+	if p, ok := up.cache[domain]; ok && !p.expired() {
+		up.mu.Unlock()
+		return p, nil
+	}
+	up.mu.Unlock()
+
+	txts, err := net.LookupTXT("_mta-sts." + domain)
+	if err != nil {
+		return nil, nil // no MTA-STS record published - not an error, just nothing to enforce
+	}
+	found := false
+	for _, t := range txts {
+		if strings.HasPrefix(t, "v=STSv1") {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, nil
+	}
+
+	resp, err := http.Get(fmt.Sprintf("https://mta-sts.%s/.well-known/mta-sts.txt", domain))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &mtaSTSPolicy{mode: "none", maxAge: time.Hour, fetchedAt: time.Now()}
+	for _, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimSpace(line)
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key, val := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		switch key {
+		case "mode":
+			p.mode = val
+		case "mx":
+			p.mxPatterns = append(p.mxPatterns, val)
+		case "max_age":
+			if secs, err := time.ParseDuration(val + "s"); err == nil {
+				p.maxAge = secs
+			}
+		}
+	}
+
+	up.mu.Lock()
+	up.cache[domain] = p
+	up.mu.Unlock()
+	return p, nil
+}
+
+// lookupTLSA queries "_25._tcp.<mxHost>" for TLSA records via the configured DNSSEC-validating resolver.
+// Records are only trusted when the response carries the DNSSEC Authenticated Data (AD) bit.
+func (up *UpstreamPolicy) lookupTLSA(mxHost string) ([]tlsaRecord, error) {
+	qname := "_25._tcp." + strings.TrimSuffix(mxHost, ".") + "."
+	var msg dnsmessage.Message
+	msg.Header.ID = 1
+	msg.Header.RecursionDesired = true
+	name, err := dnsmessage.NewName(qname)
+	if err != nil {
+		return nil, err
+	}
+	msg.Questions = []dnsmessage.Question{{
+		Name:  name,
+		Type:  dnsmessage.Type(52), // TLSA has no constant in dnsmessage; RFC 6698 assigns type 52
+		Class: dnsmessage.ClassINET,
+	}}
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.DialTimeout("udp", up.resolver, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(packed); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp dnsmessage.Message
+	if err := resp.Unpack(buf[:n]); err != nil {
+		return nil, err
+	}
+	if !resp.AuthenticData {
+		return nil, fmt.Errorf("upstreampolicy: TLSA response for %s was not DNSSEC-authenticated", qname)
+	}
+
+	var records []tlsaRecord
+	for _, rr := range resp.Answers {
+		if rr.Header.Type != dnsmessage.Type(52) {
+			continue
+		}
+		raw, ok := rr.Body.(*dnsmessage.UnknownResource)
+		if !ok || len(raw.Data) < 3 {
+			continue
+		}
+		records = append(records, tlsaRecord{
+			usage:        raw.Data[0],
+			selector:     raw.Data[1],
+			matchingType: raw.Data[2],
+			data:         raw.Data[3:],
+		})
+	}
+	return records, nil
+}
+
+// matches reports whether cert satisfies this TLSA record under DANE-EE(3) or DANE-TA(2) semantics,
+// using SPKI (selector 1) or full-certificate (selector 0) SHA-256 (matching type 1) comparison.
+func (t *tlsaRecord) matches(cert *x509.Certificate) bool {
+	if t.matchingType != 1 { // only SHA-256 is supported
+		return false
+	}
+	var subject []byte
+	if t.selector == 1 {
+		subject = cert.RawSubjectPublicKeyInfo
+	} else {
+		subject = cert.Raw
+	}
+	sum := sha256.Sum256(subject)
+	return bytes.Equal(sum[:], t.data)
+}
+
+// resolveMX returns domain's highest-priority (lowest preference value) MX host, used for MTA-STS mx
+// pattern matching and the DANE TLSA lookup - RFC 7672 section 2 puts the TLSA record under
+// "_25._tcp.<mx>", not under the domain itself. Falls back to domain when no MX records are published,
+// e.g. a destination that accepts mail directly on its own name.
+func (up *UpstreamPolicy) resolveMX(domain string) string {
+	mxs, err := net.LookupMX(domain)
+	if err != nil || len(mxs) == 0 {
+		return domain
+	}
+	best := mxs[0]
+	for _, mx := range mxs[1:] {
+		if mx.Pref < best.Pref {
+			best = mx
+		}
+	}
+	return strings.TrimSuffix(best.Host, ".")
+}
+
+// Verify enforces MTA-STS and DANE policy for a connection to domain (the destination whose MX this
+// dial is expected to reach) bearing the given certificate chain, as presented by the server and not yet
+// verified (Verify does its own PKIX check). It returns an error when enforce-mode
+// policy is violated; callers in enforce mode must treat a non-nil error as fatal for the session.
+func (up *UpstreamPolicy) Verify(domain string, rawCerts [][]byte) error {
+	if !up.enabled || len(rawCerts) == 0 {
+		return nil
+	}
+	certs := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+	}
+	leaf := certs[0]
+	mxHost := up.resolveMX(domain)
+
+	tlsaRecords, err := up.lookupTLSA(mxHost)
+	if err != nil {
+		up.logf("DANE: %v", err)
+	}
+	matched := false
+	daneEEMatched := false
+	for _, rec := range tlsaRecords {
+		if rec.usage != 2 && rec.usage != 3 {
+			continue // only DANE-TA(2) and DANE-EE(3) are implemented
+		}
+		for i, c := range certs {
+			if rec.usage == 3 && i > 0 {
+				continue // DANE-EE(3) only ever matches the leaf certificate
+			}
+			if rec.matches(c) {
+				matched = true
+				if rec.usage == 3 {
+					daneEEMatched = true
+				}
+			}
+		}
+	}
+
+	// RFC 7672 section 2.2: a DANE-EE(3) match authenticates the leaf directly and bypasses PKIX
+	// (hostname/expiry/chain-of-trust) checks entirely. Without one, PKIX must pass as usual.
+	if !daneEEMatched {
+		pool := x509.NewCertPool()
+		for _, c := range certs[1:] {
+			pool.AddCert(c)
+		}
+		if _, err := leaf.Verify(x509.VerifyOptions{DNSName: mxHost, Intermediates: pool}); err != nil {
+			return fmt.Errorf("upstreampolicy: PKIX verification failed for %s: %w", mxHost, err)
+		}
+	}
+
+	policy, err := up.policyFor(domain)
+	if err != nil {
+		return err
+	}
+	if policy != nil && policy.mode == "enforce" && !policy.matchesMX(mxHost) {
+		return fmt.Errorf("upstreampolicy: %s is not listed in the MTA-STS policy for %s", mxHost, domain)
+	}
+
+	for _, rec := range tlsaRecords {
+		if rec.usage == 2 || rec.usage == 3 {
+			if !matched {
+				return fmt.Errorf("upstreampolicy: no TLSA record for %s matched the presented certificate chain", mxHost)
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// logf reports best-effort diagnostics; a DANE lookup failure falls back to MTA-STS/PKIX rather than
+// blocking the session outright.
+func (up *UpstreamPolicy) logf(format string, args ...interface{}) {
+	log.Printf("upstreampolicy: "+format, args...)
+}